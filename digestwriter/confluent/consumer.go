@@ -0,0 +1,368 @@
+/*
+Copyright © 2022 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+//go:build confluent
+
+// Package confluent provides a digestwriter.Consumer implementation backed
+// by github.com/confluentinc/confluent-kafka-go, which wraps librdkafka via
+// cgo. It mirrors digestwriter.KafkaConsumer's ProcessMessage/
+// Storage.WriteDigests pipeline, including its retry-with-backoff and
+// dead-letter handling, SASL/TLS security configuration, pluggable
+// Deserializer and Prometheus metrics, but uses a Poll-based loop instead
+// of Sarama's ConsumerGroupHandler callbacks, and does not support
+// KAFKA_PROCESSING_MODE=exactly-once. It is only compiled into binaries
+// built with the "confluent" build tag, keeping the default, pure-Go build
+// free of the cgo/librdkafka dependency.
+package confluent
+
+import (
+	"app/base/utils"
+	"app/digestwriter"
+	"app/digestwriter/metrics"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// key for error message used in structured log messages
+	errorKey = "error"
+
+	// key for retry attempt count used in structured log messages
+	attemptKey = "attempt"
+
+	// headerOriginalTopic carries the topic a dead-lettered message came from
+	headerOriginalTopic = "original-topic"
+
+	// headerOriginalPartition carries the partition a dead-lettered message came from
+	headerOriginalPartition = "original-partition"
+
+	// headerOriginalOffset carries the offset a dead-lettered message came from
+	headerOriginalOffset = "original-offset"
+
+	// headerError carries the string representation of the last processing error
+	headerError = "error"
+
+	// headerAttempts carries the number of processing attempts made before dead-lettering
+	headerAttempts = "attempts"
+)
+
+// pollTimeout bounds how long a single Consumer.Poll call blocks while
+// waiting for the next message
+const pollTimeout = 100 * time.Millisecond
+
+func init() {
+	digestwriter.RegisterConfluentBackend(NewConsumer)
+}
+
+// ConfluentConsumer implements digestwriter.Consumer on top of
+// confluent-kafka-go
+type ConfluentConsumer struct {
+	Config                               digestwriter.CommonConsumerConfig
+	Consumer                             *kafka.Consumer
+	DeadLetterProducer                   *kafka.Producer
+	Deserializer                         digestwriter.Deserializer
+	Storage                              digestwriter.Storage
+	Logger                               *logrus.Logger
+	numberOfSuccessfullyConsumedMessages uint64
+	numberOfErrorsConsumingMessages      uint64
+	cancel                               chan struct{}
+	polling                              int32
+}
+
+// NewConsumer constructs a new ConfluentConsumer. It is registered with the
+// digestwriter package as the factory used for digestwriter.ConfluentBackend
+func NewConsumer(config digestwriter.CommonConsumerConfig, storage digestwriter.Storage, logger *logrus.Logger) (digestwriter.Consumer, error) {
+	securityConfig, err := digestwriter.SecurityConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	securityProps, err := securityConfig.ApplyToConfigMap()
+	if err != nil {
+		return nil, err
+	}
+
+	consumerConfigMap := &kafka.ConfigMap{
+		"bootstrap.servers":  config.Address,
+		"group.id":           config.Group,
+		"enable.auto.commit": false,
+		"auto.offset.reset":  "earliest",
+	}
+	for key, value := range securityProps {
+		if err := consumerConfigMap.SetKey(key, value); err != nil {
+			return nil, err
+		}
+	}
+
+	consumer, err := kafka.NewConsumer(consumerConfigMap)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := consumer.Subscribe(config.IncomingTopic, nil); err != nil {
+		return nil, err
+	}
+
+	var deadLetterProducer *kafka.Producer
+	if config.DeadLetterTopic != "" {
+		producerConfigMap := &kafka.ConfigMap{
+			"bootstrap.servers": config.Address,
+		}
+		for key, value := range securityProps {
+			if err := producerConfigMap.SetKey(key, value); err != nil {
+				return nil, err
+			}
+		}
+
+		deadLetterProducer, err = kafka.NewProducer(producerConfigMap)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	payloadFormat := digestwriter.PayloadFormat(utils.Getenv("KAFKA_PAYLOAD_FORMAT", string(digestwriter.PayloadFormatJSON)))
+	deserializer, err := digestwriter.NewDeserializer(
+		payloadFormat,
+		utils.Getenv("KAFKA_JSON_SCHEMA_PATH", ""),
+		utils.Getenv("KAFKA_SCHEMA_REGISTRY_URL", ""),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ConfluentConsumer{
+		Config:             config,
+		Consumer:           consumer,
+		DeadLetterProducer: deadLetterProducer,
+		Deserializer:       deserializer,
+		Storage:            storage,
+		Logger:             logger,
+		cancel:             make(chan struct{}),
+	}, nil
+}
+
+// Serve starts polling for messages and processing them. It blocks the
+// current thread until Close is called
+func (consumer *ConfluentConsumer) Serve() {
+	consumer.Logger.Info("Started serving confluent consumer")
+	atomic.StoreInt32(&consumer.polling, 1)
+	defer atomic.StoreInt32(&consumer.polling, 0)
+
+	for {
+		select {
+		case <-consumer.cancel:
+			consumer.Logger.Info("Context cancelled, exiting")
+			return
+		default:
+		}
+
+		event := consumer.Consumer.Poll(int(pollTimeout.Milliseconds()))
+		if event == nil {
+			continue
+		}
+
+		switch e := event.(type) {
+		case *kafka.Message:
+			consumer.handleMessage(e)
+		case kafka.Error:
+			consumer.Logger.WithFields(logrus.Fields{
+				errorKey: e,
+			}).Error("Error polling confluent consumer")
+		}
+	}
+}
+
+// SessionAlive reports whether Serve's poll loop is currently running, the
+// counterpart of digestwriter.KafkaConsumer.SessionAlive. digestwriter.Server
+// takes a *digestwriter.KafkaConsumer, so this method does not back /healthz
+func (consumer *ConfluentConsumer) SessionAlive() bool {
+	return atomic.LoadInt32(&consumer.polling) == 1
+}
+
+// Close stops polling and releases the underlying librdkafka handles
+func (consumer *ConfluentConsumer) Close() error {
+	close(consumer.cancel)
+
+	if consumer.DeadLetterProducer != nil {
+		consumer.DeadLetterProducer.Close()
+	}
+
+	return consumer.Consumer.Close()
+}
+
+// GetNumberOfSuccessfullyConsumedMessages returns number of consumed
+// messages since creating ConfluentConsumer obj
+func (consumer *ConfluentConsumer) GetNumberOfSuccessfullyConsumedMessages() uint64 {
+	return consumer.numberOfSuccessfullyConsumedMessages
+}
+
+// GetNumberOfErrorsConsumingMessages returns number of errors during
+// consuming messages since creating ConfluentConsumer obj
+func (consumer *ConfluentConsumer) GetNumberOfErrorsConsumingMessages() uint64 {
+	return consumer.numberOfErrorsConsumingMessages
+}
+
+// handleMessage handles the message and does all logging, metrics, etc,
+// mirroring digestwriter.KafkaConsumer.handleMessage
+func (consumer *ConfluentConsumer) handleMessage(msg *kafka.Message) {
+	startTime := time.Now()
+	err := consumer.processMessageWithRetry(msg)
+	processingDuration := time.Since(startTime).Seconds()
+
+	topic := ""
+	if msg.TopicPartition.Topic != nil {
+		topic = *msg.TopicPartition.Topic
+	}
+	partition := strconv.Itoa(int(msg.TopicPartition.Partition))
+	metrics.ProcessingDuration.WithLabelValues(topic, partition).Observe(processingDuration)
+
+	if err != nil {
+		consumer.Logger.WithFields(logrus.Fields{
+			errorKey: err,
+		}).Error("Error processing the message consumed from Kafka")
+		consumer.numberOfErrorsConsumingMessages++
+		return
+	}
+
+	if _, err := consumer.Consumer.CommitMessage(msg); err != nil {
+		consumer.Logger.WithFields(logrus.Fields{
+			errorKey: err,
+		}).Error("Error committing message offset")
+	}
+
+	consumer.numberOfSuccessfullyConsumedMessages++
+	metrics.ConsumedMessages.Inc()
+}
+
+// processMessageWithRetry calls ProcessMessage, retrying with exponential
+// backoff and jitter up to Config.MaxRetries times, mirroring
+// digestwriter.KafkaConsumer.processMessageWithRetry. If every attempt
+// fails, the message is routed to the dead-letter topic (when configured)
+// instead of being dropped
+func (consumer *ConfluentConsumer) processMessageWithRetry(msg *kafka.Message) error {
+	var err error
+	attempts := 0
+
+	for attempt := 0; attempt <= consumer.Config.MaxRetries; attempt++ {
+		attempts++
+		err = consumer.ProcessMessage(msg)
+		if err == nil {
+			return nil
+		}
+
+		var deserializationErr *digestwriter.DeserializationError
+		if errors.As(err, &deserializationErr) {
+			consumer.Logger.WithFields(logrus.Fields{
+				errorKey: err,
+			}).Warn("Message failed deserialization/validation, skipping retries")
+			break
+		}
+
+		if attempt == consumer.Config.MaxRetries {
+			break
+		}
+
+		consumer.Logger.WithFields(logrus.Fields{
+			errorKey:   err,
+			attemptKey: attempt,
+		}).Warn("Failed to process message, will retry")
+
+		time.Sleep(digestwriter.BackoffWithJitter(consumer.Config.RetryBackoff, attempt))
+	}
+
+	if consumer.Config.DeadLetterTopic == "" {
+		return err
+	}
+
+	if dlqErr := consumer.produceToDeadLetter(msg, err, attempts); dlqErr != nil {
+		consumer.Logger.WithFields(logrus.Fields{
+			errorKey: dlqErr,
+		}).Error("Unable to produce message to dead-letter topic")
+		return err
+	}
+
+	consumer.Logger.Info("Message routed to dead-letter topic after exhausting retries")
+	return nil
+}
+
+// produceToDeadLetter publishes the original message to the configured
+// dead-letter topic, carrying the original topic/partition/offset, the
+// processing error and the number of attempts made in message headers,
+// mirroring digestwriter.KafkaConsumer.produceToDeadLetter
+func (consumer *ConfluentConsumer) produceToDeadLetter(msg *kafka.Message, processingErr error, attempts int) error {
+	originalTopic := ""
+	if msg.TopicPartition.Topic != nil {
+		originalTopic = *msg.TopicPartition.Topic
+	}
+
+	dlqTopic := consumer.Config.DeadLetterTopic
+	dlqMessage := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &dlqTopic, Partition: kafka.PartitionAny},
+		Key:            msg.Key,
+		Value:          msg.Value,
+		Headers: []kafka.Header{
+			{Key: headerOriginalTopic, Value: []byte(originalTopic)},
+			{Key: headerOriginalPartition, Value: []byte(strconv.Itoa(int(msg.TopicPartition.Partition)))},
+			{Key: headerOriginalOffset, Value: []byte(msg.TopicPartition.Offset.String())},
+			{Key: headerError, Value: []byte(processingErr.Error())},
+			{Key: headerAttempts, Value: []byte(strconv.Itoa(attempts))},
+		},
+	}
+
+	deliveryChan := make(chan kafka.Event, 1)
+	if err := consumer.DeadLetterProducer.Produce(dlqMessage, deliveryChan); err != nil {
+		return err
+	}
+
+	report := (<-deliveryChan).(*kafka.Message)
+	return report.TopicPartition.Error
+}
+
+// ProcessMessage processes an incoming message, reusing the exact same
+// Deserializer, digest-extraction logic and metrics as the Sarama-backed
+// consumer
+func (consumer *ConfluentConsumer) ProcessMessage(msg *kafka.Message) error {
+	message, err := consumer.Deserializer.Deserialize(msg.Value)
+	if err != nil {
+		metrics.ParseErrors.Inc()
+		return &digestwriter.DeserializationError{Err: err}
+	}
+
+	if message.Digests == nil {
+		consumer.Logger.Info("No digests were retrieved from incoming message")
+		return nil
+	}
+
+	digests := digestwriter.ExtractDigestsFromMessage(message.Digests)
+
+	if message.ImageCount != len(digests) {
+		consumer.Logger.Warnf("Expected number of digests: %d; Extracted digests: %d", message.ImageCount, len(digests))
+	}
+
+	if err := consumer.Storage.WriteDigests(digests); err != nil {
+		consumer.Logger.WithFields(logrus.Fields{
+			errorKey: err,
+		}).Error("Error writing digests to database")
+		metrics.StoreErrors.Inc()
+		return err
+	}
+
+	return nil
+}
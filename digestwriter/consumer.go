@@ -27,9 +27,15 @@ package digestwriter
 
 import (
 	"app/base/utils"
+	"app/digestwriter/metrics"
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Shopify/sarama"
@@ -51,8 +57,56 @@ const (
 
 	// key for duration of message processing used in structured log messages
 	processingDurationKey = "processing_duration"
+
+	// key for retry attempt count used in structured log messages
+	attemptKey = "attempt"
+
+	// defaultMaxRetries is used when KAFKA_MAX_RETRIES is not configured
+	defaultMaxRetries = 3
+
+	// defaultRetryBackoff is used when KAFKA_RETRY_BACKOFF is not configured
+	defaultRetryBackoff = 500 * time.Millisecond
+
+	// headerOriginalTopic carries the topic a dead-lettered message came from
+	headerOriginalTopic = "original-topic"
+
+	// headerOriginalPartition carries the partition a dead-lettered message came from
+	headerOriginalPartition = "original-partition"
+
+	// headerOriginalOffset carries the offset a dead-lettered message came from
+	headerOriginalOffset = "original-offset"
+
+	// headerError carries the string representation of the last processing error
+	headerError = "error"
+
+	// headerAttempts carries the number of processing attempts made before dead-lettering
+	headerAttempts = "attempts"
+
+	// defaultTransactionTimeout is used when KAFKA_TRANSACTION_TIMEOUT is not configured
+	defaultTransactionTimeout = 1 * time.Minute
+
+	// defaultParallelMessages is used when KAFKA_PARALLEL_MESSAGES is not
+	// configured, i.e. messages of a partition are processed one at a time
+	defaultParallelMessages = 1
 	)
 
+// ProcessingMode selects the delivery semantics used by KafkaConsumer
+type ProcessingMode string
+
+const (
+	// AtLeastOnce marks messages as consumed once ProcessMessage returns,
+	// which may re-deliver a message if the consumer crashes right after
+	// storage has been written but before the offset commit took effect.
+	AtLeastOnce ProcessingMode = "at-least-once"
+
+	// ExactlyOnce commits each message's consumer offset as part of a
+	// Kafka transaction that is opened once the message has been
+	// processed, and marks the message only once that commit succeeds.
+	// The storage write is not part of the transaction, so a crash
+	// between the write and the commit still re-delivers the message.
+	ExactlyOnce ProcessingMode = "exactly-once"
+)
+
 // ClusterName represents the external cluster UUID contained in the consumed message
 type ClusterName string
 
@@ -68,33 +122,119 @@ type IncomingMessage struct {
 	Namespaces  *JsonContent    `json:"-"`
 }
 
-// Consumer interface for a topic consumer for any message broker
+// Consumer interface for a topic consumer for any message broker. It is
+// intentionally broker-agnostic: backend-specific consumers (Sarama,
+// confluent-kafka-go, ...) keep their own ProcessMessage method with a
+// signature matching their client library's message type, see ConsumerBackend.
 type Consumer interface {
 	Serve()
 	Close() error
-	ProcessMessage(msg *sarama.ConsumerMessage) error
 }
 
-// KafkaConsumerConfig represents the configuration for communicating
-// with Kafka broker
-type KafkaConsumerConfig struct {
+// ConsumerBackend selects the underlying Kafka client library used by
+// NewConsumer
+type ConsumerBackend string
+
+const (
+	// SaramaBackend uses the pure-Go github.com/Shopify/sarama client and
+	// is the default, requiring no cgo dependency
+	SaramaBackend ConsumerBackend = "sarama"
+
+	// ConfluentBackend uses github.com/confluentinc/confluent-kafka-go,
+	// which wraps librdkafka via cgo, for higher throughput on large
+	// clusters. Only available in binaries built with the "confluent"
+	// build tag, see digestwriter/confluent
+	ConfluentBackend ConsumerBackend = "confluent"
+)
+
+// ConfluentFactory is populated by digestwriter/confluent's init()
+// function when the binary is built with the "confluent" build tag. It
+// stays nil otherwise, which is how NewConsumer detects that the
+// confluent-kafka-go backend was not linked into this binary
+var ConfluentFactory func(config CommonConsumerConfig, storage Storage, logger *logrus.Logger) (Consumer, error)
+
+// RegisterConfluentBackend lets the optional confluent-kafka-go based
+// Consumer implementation plug itself in without this package needing a
+// hard (cgo) dependency on librdkafka
+func RegisterConfluentBackend(factory func(config CommonConsumerConfig, storage Storage, logger *logrus.Logger) (Consumer, error)) {
+	ConfluentFactory = factory
+}
+
+// CommonConsumerConfig holds the configuration shared by every Consumer
+// backend, regardless of the underlying Kafka client library
+type CommonConsumerConfig struct {
 	// Address represents Kafka address
 	Address string
 	// IncomingTopic is name of Kafka topic to consume from
 	IncomingTopic string
 	// Group is name of Kafka consumer group
 	Group string
+	// DeadLetterTopic is the name of the Kafka topic un-processable
+	// messages are produced to once all retries have been exhausted. If
+	// empty, the dead-letter pipeline is disabled and such messages are
+	// only logged, same as before.
+	DeadLetterTopic string
+	// MaxRetries is the number of times processing a message (via
+	// ProcessMessage) is retried after the first failed attempt, so up to
+	// MaxRetries+1 attempts are made before it is routed to the
+	// dead-letter topic
+	MaxRetries int
+	// RetryBackoff is the base delay used for the exponential backoff
+	// applied between retry attempts. Actual delay is
+	// RetryBackoff * 2^attempt, plus jitter
+	RetryBackoff time.Duration
+}
+
+// KafkaConsumerConfig represents the configuration for communicating
+// with Kafka broker
+type KafkaConsumerConfig struct {
+	CommonConsumerConfig
+	// ProcessingMode selects between AtLeastOnce (default) and
+	// ExactlyOnce delivery semantics
+	ProcessingMode ProcessingMode
+	// TransactionTimeout bounds how long a Kafka transaction opened in
+	// ExactlyOnce mode is allowed to stay open
+	TransactionTimeout time.Duration
+	// ParallelMessages is the number of messages of a single partition
+	// claim that are processed concurrently by a worker pool. Offsets are
+	// still committed in order, so this only affects throughput, not
+	// at-least-once semantics. A value of 1 (the default) preserves the
+	// original strictly sequential behaviour
+	ParallelMessages int
+	// PayloadFormat selects the Deserializer used to decode a message
+	// value into an IncomingMessage. Defaults to PayloadFormatJSON
+	PayloadFormat PayloadFormat
+	// JSONSchemaPath is the path to the JSON Schema document messages are
+	// validated against when PayloadFormat is PayloadFormatJSON. Optional;
+	// when empty, messages are only checked for the required attributes
+	// as before
+	JSONSchemaPath string
+	// SchemaRegistryURL is the base URL of the Confluent Schema Registry
+	// used to resolve schema IDs when PayloadFormat is PayloadFormatAvro
+	// (PayloadFormatProtobuf is rejected by NewDeserializer)
+	SchemaRegistryURL string
 }
 
 type KafkaConsumer struct {
 	Config                               KafkaConsumerConfig
 	ConsumerGroup                        sarama.ConsumerGroup
+	DeadLetterProducer                   sarama.SyncProducer
+	SaramaConfig                         *sarama.Config
+	Deserializer                         Deserializer
 	Storage                              Storage
 	Logger 								 *logrus.Logger
+	// numberOf* counters are incremented from handleMessage, which
+	// consumeClaimParallel may call from multiple worker goroutines at
+	// once, so they must only ever be accessed via the sync/atomic
+	// functions, never with ++
 	numberOfSuccessfullyConsumedMessages uint64
 	numberOfErrorsConsumingMessages      uint64
+	numberOfRetriableErrors              uint64
+	numberOfTerminalErrors               uint64
 	Ready                                chan bool
+	readyMu                              sync.Mutex
 	Cancel                               context.CancelFunc
+	sessionAlive                         int32
 }
 
 // DefaultSaramaConfig is a config which will be used by default
@@ -102,11 +242,76 @@ type KafkaConsumer struct {
 // useful for testing
 var DefaultSaramaConfig *sarama.Config
 
-// NewConsumer constructs new implementation of Consumer interface
-func NewConsumer(storage Storage, logger *logrus.Logger) (*KafkaConsumer, error) {
+// NewConsumer constructs new implementation of Consumer interface, backed
+// by the Kafka client library selected via KAFKA_CONSUMER_BACKEND
+// ("sarama", the default, or "confluent")
+func NewConsumer(storage Storage, logger *logrus.Logger) (Consumer, error) {
+	backend := ConsumerBackend(utils.Getenv("KAFKA_CONSUMER_BACKEND", string(SaramaBackend)))
+
+	if backend == ConfluentBackend {
+		if ConfluentFactory == nil {
+			return nil, errors.New("confluent backend requested via KAFKA_CONSUMER_BACKEND but this binary was built without the 'confluent' build tag")
+		}
+
+		common, err := commonConfigFromEnv(logger)
+		if err != nil {
+			return nil, err
+		}
+
+		return ConfluentFactory(common, storage, logger)
+	}
+
 	return NewWithSaramaConfig(DefaultSaramaConfig, storage, logger)
 }
 
+// commonConfigFromEnv reads the configuration shared by every Consumer
+// backend from the environment
+func commonConfigFromEnv(logger *logrus.Logger) (CommonConsumerConfig, error) {
+	brokerAddress := utils.Getenv("KAFKA_BROKER_ADDRESS", "")
+	if brokerAddress == "" {
+		return CommonConsumerConfig{}, errors.New("unable to get env var: KAFKA_BROKER_ADDRESS")
+	}
+	group := utils.Getenv("KAFKA_BROKER_CONSUMER_GROUP", "")
+	if group == "" {
+		return CommonConsumerConfig{}, errors.New("unable to get env var: KAFKA_BROKER_CONSUMER_GROUP")
+	}
+	topic := utils.Getenv("KAFKA_BROKER_INCOMING_TOPIC", "")
+	if topic == "" {
+		return CommonConsumerConfig{}, errors.New("unable to get env var: KAFKA_BROKER_INCOMING_TOPIC")
+	}
+
+	maxRetries := defaultMaxRetries
+	if raw := utils.Getenv("KAFKA_MAX_RETRIES", ""); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed >= 0 {
+			maxRetries = parsed
+		} else {
+			logger.WithFields(logrus.Fields{
+				errorKey: err,
+			}).Warn("Invalid KAFKA_MAX_RETRIES, using default")
+		}
+	}
+
+	retryBackoff := defaultRetryBackoff
+	if raw := utils.Getenv("KAFKA_RETRY_BACKOFF", ""); raw != "" {
+		if parsed, err := time.ParseDuration(raw); err == nil && parsed > 0 {
+			retryBackoff = parsed
+		} else {
+			logger.WithFields(logrus.Fields{
+				errorKey: err,
+			}).Warn("Invalid KAFKA_RETRY_BACKOFF, using default")
+		}
+	}
+
+	return CommonConsumerConfig{
+		Address:         brokerAddress,
+		IncomingTopic:   topic,
+		Group:           group,
+		DeadLetterTopic: utils.Getenv("KAFKA_DEAD_LETTER_TOPIC", ""),
+		MaxRetries:      maxRetries,
+		RetryBackoff:    retryBackoff,
+	}, nil
+}
+
 // NewWithSaramaConfig constructs new implementation of Consumer interface with custom sarama config
 func NewWithSaramaConfig(
 	saramaConfig *sarama.Config,
@@ -138,6 +343,18 @@ func NewWithSaramaConfig(
 		}
 	}
 
+	securityConfig, err := SecurityConfigFromEnv()
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			errorKey: err,
+		}).Fatal("Invalid Kafka SASL/TLS configuration")
+	}
+	if err := securityConfig.Apply(saramaConfig); err != nil {
+		logger.WithFields(logrus.Fields{
+			errorKey: err,
+		}).Fatal("Unable to apply Kafka SASL/TLS configuration")
+	}
+
 	consumerGroup, err := sarama.NewConsumerGroup([]string{brokerAddress}, group, saramaConfig)
 	if err != nil {
 		logger.WithFields(logrus.Fields{
@@ -145,14 +362,108 @@ func NewWithSaramaConfig(
 		}).Fatal("Couldn't setup Kafka consumer group with given config")
 	}
 
+	deadLetterTopic := utils.Getenv("KAFKA_DEAD_LETTER_TOPIC", "")
+
+	maxRetries := defaultMaxRetries
+	if raw := utils.Getenv("KAFKA_MAX_RETRIES", ""); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed >= 0 {
+			maxRetries = parsed
+		} else {
+			logger.WithFields(logrus.Fields{
+				errorKey: err,
+			}).Warn("Invalid KAFKA_MAX_RETRIES, using default")
+		}
+	}
+
+	retryBackoff := defaultRetryBackoff
+	if raw := utils.Getenv("KAFKA_RETRY_BACKOFF", ""); raw != "" {
+		if parsed, err := time.ParseDuration(raw); err == nil && parsed > 0 {
+			retryBackoff = parsed
+		} else {
+			logger.WithFields(logrus.Fields{
+				errorKey: err,
+			}).Warn("Invalid KAFKA_RETRY_BACKOFF, using default")
+		}
+	}
+
+	var deadLetterProducer sarama.SyncProducer
+	if deadLetterTopic != "" {
+		producerConfig := sarama.NewConfig()
+		producerConfig.Version = saramaConfig.Version
+		producerConfig.Producer.Return.Successes = true
+		if err := securityConfig.Apply(producerConfig); err != nil {
+			logger.WithFields(logrus.Fields{
+				errorKey: err,
+			}).Fatal("Unable to apply Kafka SASL/TLS configuration to dead-letter producer")
+		}
+
+		deadLetterProducer, err = sarama.NewSyncProducer([]string{brokerAddress}, producerConfig)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				errorKey: err,
+			}).Fatal("Couldn't setup Kafka dead-letter producer with given config")
+		}
+	}
+
+	processingMode := AtLeastOnce
+	if ProcessingMode(utils.Getenv("KAFKA_PROCESSING_MODE", "")) == ExactlyOnce {
+		processingMode = ExactlyOnce
+	}
+
+	transactionTimeout := defaultTransactionTimeout
+	if raw := utils.Getenv("KAFKA_TRANSACTION_TIMEOUT", ""); raw != "" {
+		if parsed, err := time.ParseDuration(raw); err == nil && parsed > 0 {
+			transactionTimeout = parsed
+		} else {
+			logger.WithFields(logrus.Fields{
+				errorKey: err,
+			}).Warn("Invalid KAFKA_TRANSACTION_TIMEOUT, using default")
+		}
+	}
+
+	parallelMessages := defaultParallelMessages
+	if raw := utils.Getenv("KAFKA_PARALLEL_MESSAGES", ""); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed >= 1 {
+			parallelMessages = parsed
+		} else {
+			logger.WithFields(logrus.Fields{
+				errorKey: err,
+			}).Warn("Invalid KAFKA_PARALLEL_MESSAGES, using default")
+		}
+	}
+
+	payloadFormat := PayloadFormat(utils.Getenv("KAFKA_PAYLOAD_FORMAT", string(PayloadFormatJSON)))
+	jsonSchemaPath := utils.Getenv("KAFKA_JSON_SCHEMA_PATH", "")
+	schemaRegistryURL := utils.Getenv("KAFKA_SCHEMA_REGISTRY_URL", "")
+
+	deserializer, err := NewDeserializer(payloadFormat, jsonSchemaPath, schemaRegistryURL)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			errorKey: err,
+		}).Fatal("Unable to configure Kafka payload deserializer")
+	}
 
 	consumer := &KafkaConsumer{
 		Config: KafkaConsumerConfig{
-			Address:       brokerAddress,
-			IncomingTopic: topic,
-			Group:         group,
+			CommonConsumerConfig: CommonConsumerConfig{
+				Address:         brokerAddress,
+				IncomingTopic:   topic,
+				Group:           group,
+				DeadLetterTopic: deadLetterTopic,
+				MaxRetries:      maxRetries,
+				RetryBackoff:    retryBackoff,
+			},
+			ProcessingMode:     processingMode,
+			TransactionTimeout: transactionTimeout,
+			ParallelMessages:   parallelMessages,
+			PayloadFormat:      payloadFormat,
+			JSONSchemaPath:     jsonSchemaPath,
+			SchemaRegistryURL:  schemaRegistryURL,
 		},
 		ConsumerGroup:                        consumerGroup,
+		DeadLetterProducer:                   deadLetterProducer,
+		SaramaConfig:                         saramaConfig,
+		Deserializer:                         deserializer,
 		Storage:                              storage,
 		Logger:                               logger,
 		numberOfSuccessfullyConsumedMessages: 0,
@@ -186,13 +497,15 @@ func (consumer *KafkaConsumer) Serve() {
 
 			consumer.Logger.Info("Created new kafka session")
 
+			consumer.readyMu.Lock()
 			consumer.Ready = make(chan bool)
+			consumer.readyMu.Unlock()
 		}
 	}()
 
 	// Wait until the consumer is ready
 	consumer.Logger.Info("Waiting for consumer to become ready")
-	<-consumer.Ready
+	<-consumer.currentReady()
 	consumer.Logger.Info("Consumer is ready")
 
 	// Actual processing is done in goroutine created by sarama (see ConsumeClaim below)
@@ -206,24 +519,68 @@ func (consumer *KafkaConsumer) Serve() {
 // Setup is run at the beginning of a new session, before ConsumeClaim
 func (consumer *KafkaConsumer) Setup(sarama.ConsumerGroupSession) error {
 	consumer.Logger.Info("New session has been setup")
+	atomic.StoreInt32(&consumer.sessionAlive, 1)
 	// Mark the consumer as ready
+	consumer.readyMu.Lock()
 	close(consumer.Ready)
+	consumer.readyMu.Unlock()
 	return nil
 }
 
+// currentReady returns the Ready channel of the session currently being
+// set up. Ready is replaced on every new Kafka session (see Serve), so
+// reads and writes of the field itself, not just of the channel, must be
+// synchronized via readyMu.
+func (consumer *KafkaConsumer) currentReady() chan bool {
+	consumer.readyMu.Lock()
+	defer consumer.readyMu.Unlock()
+	return consumer.Ready
+}
+
+// IsReady reports whether the current consumer group session has
+// completed setup, i.e. whether its Ready channel has been closed. Unlike
+// reading the Ready field directly, this is safe to call concurrently
+// with Serve's session-management goroutine, which replaces Ready on
+// every rebalance. It backs the /readyz endpoint exposed by Server.
+func (consumer *KafkaConsumer) IsReady() bool {
+	select {
+	case <-consumer.currentReady():
+		return true
+	default:
+		return false
+	}
+}
+
 // Cleanup is run at the end of a session, once all ConsumeClaim goroutines have exited
 func (consumer *KafkaConsumer) Cleanup(sarama.ConsumerGroupSession) error {
 	consumer.Logger.Info("New session has been terminated")
+	atomic.StoreInt32(&consumer.sessionAlive, 0)
 	return nil
 }
 
+// SessionAlive reports whether a consumer group session is currently set
+// up, i.e. whether Setup has fired without a matching Cleanup yet. It
+// backs the /healthz endpoint exposed by Server
+func (consumer *KafkaConsumer) SessionAlive() bool {
+	return atomic.LoadInt32(&consumer.sessionAlive) == 1
+}
+
 // ConsumeClaim starts a consumer loop of ConsumerGroupClaim's Messages().
 func (consumer *KafkaConsumer) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
 	consumer.Logger.WithFields(logrus.Fields{
 		offsetKey: claim.InitialOffset(),
 	}).Info("Starting messages loop")
 
+	if consumer.Config.ProcessingMode == ExactlyOnce {
+		return consumer.consumeClaimExactlyOnce(session, claim)
+	}
+
+	if consumer.Config.ParallelMessages > 1 {
+		return consumer.consumeClaimParallel(session, claim)
+	}
+
 	for message := range claim.Messages() {
+		recordLag(claim, message)
 		consumer.handleMessage(message)
 		session.MarkMessage(message, "")
 	}
@@ -231,6 +588,257 @@ func (consumer *KafkaConsumer) ConsumeClaim(session sarama.ConsumerGroupSession,
 	return nil
 }
 
+// recordLag refreshes the vuln4shift_digestwriter_consumer_lag gauge for
+// the topic/partition of the given claim, using the gap between the
+// partition's high water mark and the message about to be processed
+func recordLag(claim sarama.ConsumerGroupClaim, message *sarama.ConsumerMessage) {
+	lag := claim.HighWaterMarkOffset() - message.Offset - 1
+	if lag < 0 {
+		lag = 0
+	}
+
+	metrics.ConsumerLag.WithLabelValues(claim.Topic(), strconv.Itoa(int(claim.Partition()))).Set(float64(lag))
+}
+
+// consumeClaimParallel fans messages of a single partition claim out to a
+// bounded pool of Config.ParallelMessages workers, while still committing
+// offsets strictly in order: a dedicated goroutine only marks the longest
+// contiguous prefix of offsets whose processing has completed, so
+// at-least-once semantics are preserved even though processing itself is
+// no longer sequential. On rebalance or context cancellation, in-flight
+// work is allowed to drain before returning.
+func (consumer *KafkaConsumer) consumeClaimParallel(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	jobs := make(chan *sarama.ConsumerMessage)
+	completed := make(chan int64)
+
+	var workers sync.WaitGroup
+	for i := 0; i < consumer.Config.ParallelMessages; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for message := range jobs {
+				consumer.handleMessage(message)
+				completed <- message.Offset
+			}
+		}()
+	}
+
+	committerDone := make(chan struct{})
+	go func() {
+		defer close(committerDone)
+		commitInOrder(session, claim, completed)
+	}()
+
+	drain := func() {
+		close(jobs)
+		workers.Wait()
+		close(completed)
+		<-committerDone
+	}
+
+consumeLoop:
+	for {
+		select {
+		case message, ok := <-claim.Messages():
+			if !ok {
+				break consumeLoop
+			}
+			recordLag(claim, message)
+			jobs <- message
+		case <-session.Context().Done():
+			break consumeLoop
+		}
+	}
+
+	drain()
+	return nil
+}
+
+// commitInOrder receives the offsets of messages as their processing
+// completes (possibly out of order) and marks, via session.MarkOffset,
+// only the longest contiguous prefix of offsets starting at the claim's
+// initial offset, buffering the rest until the gap is filled.
+func commitInOrder(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim, completed <-chan int64) {
+	nextToCommit := claim.InitialOffset()
+	pending := make(map[int64]bool)
+
+	for offset := range completed {
+		pending[offset] = true
+
+		for pending[nextToCommit] {
+			delete(pending, nextToCommit)
+			session.MarkOffset(claim.Topic(), claim.Partition(), nextToCommit+1, "")
+			nextToCommit++
+		}
+	}
+}
+
+// consumeClaimExactlyOnce processes every message of the claim once via
+// handleMessage, then opens a Kafka transaction to either attach the
+// consumer offset and commit it (on success) or abort it and reset the
+// partition offset so the message is re-delivered (on failure). Only the
+// transaction itself is retried on a fatal producer error; handleMessage,
+// and so the storage write it performs, never runs twice for the same
+// delivery.
+//
+// Sarama's offset manager tracks a single "next offset to commit" per
+// partition: ResetOffset and MarkMessage/MarkOffset all write the same
+// value, with no per-message snapshotting. So after a ResetOffset, this
+// claim must stop consuming immediately instead of continuing the loop:
+// otherwise the very next successfully processed message would advance
+// that value again before it is ever flushed to the broker, and the
+// failed message would be silently skipped rather than re-delivered.
+// Returning here ends this claim for the current session, forcing a
+// rebalance so the reset offset is what gets reclaimed.
+func (consumer *KafkaConsumer) consumeClaimExactlyOnce(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	producer, err := consumer.newTransactionalProducer(claim.Partition())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := producer.Close(); err != nil {
+			consumer.Logger.WithFields(logrus.Fields{
+				errorKey: err,
+			}).Error("Unable to close transactional producer")
+		}
+	}()
+
+	for message := range claim.Messages() {
+		recordLag(claim, message)
+
+		// ProcessMessage (with its own retry/dead-letter ladder) runs at
+		// most once per message here: only the Kafka-transaction
+		// bookkeeping below is retried on a fatal producer error, so the
+		// digests are never written to storage more than once for the
+		// same delivery.
+		processErr := consumer.handleMessage(message)
+
+		for {
+			aborted, txnErr := consumer.commitMessageInTxn(producer, session, claim, message, processErr)
+			if txnErr == nil {
+				if aborted {
+					consumer.Logger.WithFields(logrus.Fields{
+						offsetKey:    message.Offset,
+						partitionKey: message.Partition,
+					}).Error("Transaction aborted after a permanent processing failure, ending this claim so the reset offset is reclaimed on rebalance")
+					return nil
+				}
+				break
+			}
+
+			if txnErr == sarama.ErrTransactionNotReady || producer.TxnStatus()&sarama.ProducerTxnFlagFatalError != 0 {
+				consumer.Logger.WithFields(logrus.Fields{
+					errorKey: txnErr,
+				}).Error("Fatal error in transactional producer, recreating it")
+
+				if closeErr := producer.Close(); closeErr != nil {
+					consumer.Logger.WithFields(logrus.Fields{
+						errorKey: closeErr,
+					}).Error("Unable to close failed transactional producer")
+				}
+
+				producer, err = consumer.newTransactionalProducer(claim.Partition())
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			consumer.Logger.WithFields(logrus.Fields{
+				errorKey:     txnErr,
+				offsetKey:    message.Offset,
+				partitionKey: message.Partition,
+			}).Error("Unable to commit transaction, ending this claim so the reset offset is reclaimed on rebalance")
+			return txnErr
+		}
+	}
+
+	return nil
+}
+
+// newTransactionalProducer builds a sarama.AsyncProducer configured for
+// transactional, exactly-once delivery. The transactional ID is derived
+// from the consumer group and partition so that zombie producers from a
+// previous generation get fenced off by the broker.
+func (consumer *KafkaConsumer) newTransactionalProducer(partition int32) (sarama.AsyncProducer, error) {
+	producerConfig := *consumer.SaramaConfig
+	producerConfig.Producer.Idempotent = true
+	producerConfig.Producer.RequiredAcks = sarama.WaitForAll
+	producerConfig.Net.MaxOpenRequests = 1
+	producerConfig.Producer.Transaction.ID = fmt.Sprintf("%s-%d", consumer.Config.Group, partition)
+	producerConfig.Producer.Transaction.Timeout = consumer.Config.TransactionTimeout
+
+	producer, err := sarama.NewAsyncProducer([]string{consumer.Config.Address}, &producerConfig)
+	if err != nil {
+		consumer.Logger.WithFields(logrus.Fields{
+			errorKey: err,
+		}).Error("Couldn't setup transactional Kafka producer")
+		return nil, err
+	}
+
+	return producer, nil
+}
+
+// commitMessageInTxn opens a Kafka transaction and decides, based on
+// processErr (the result of already having run ProcessMessage via
+// handleMessage), whether to attach the consumer offset to the
+// transaction and commit it, or abort the transaction and reset the
+// partition offset so the message is re-delivered. It never re-runs
+// ProcessMessage: a non-nil err return here only ever reflects a failure
+// in the Kafka transaction machinery itself (BeginTxn/AddOffsetsToTxn/
+// CommitTxn), which consumeClaimExactlyOnce may retry by recreating the
+// producer.
+//
+// aborted reports whether this call already reset the partition offset.
+// Sarama's offset manager tracks one "next offset to commit" per
+// partition, so once that has happened the caller must not let this
+// claim's loop advance to another message before the session ends: doing
+// so would let a later MarkMessage overwrite the reset value before it is
+// ever flushed to the broker, silently skipping the failed message
+// instead of redelivering it.
+func (consumer *KafkaConsumer) commitMessageInTxn(producer sarama.AsyncProducer, session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim, message *sarama.ConsumerMessage, processErr error) (aborted bool, err error) {
+	if err := producer.BeginTxn(); err != nil {
+		return false, err
+	}
+
+	if processErr != nil {
+		if err := producer.AbortTxn(); err != nil {
+			consumer.Logger.WithFields(logrus.Fields{
+				errorKey: err,
+			}).Error("Unable to abort transaction after processing failure")
+		}
+		session.ResetOffset(claim.Topic(), claim.Partition(), message.Offset, "")
+		return true, nil
+	}
+
+	groupOffsets := map[string][]*sarama.PartitionOffsetMetadata{
+		claim.Topic(): {
+			{
+				Partition: claim.Partition(),
+				Offset:    message.Offset + 1,
+			},
+		},
+	}
+
+	if err := producer.AddOffsetsToTxn(groupOffsets, consumer.Config.Group); err != nil {
+		_ = producer.AbortTxn()
+		return false, err
+	}
+
+	if err := producer.CommitTxn(); err != nil {
+		if abortErr := producer.AbortTxn(); abortErr != nil {
+			consumer.Logger.WithFields(logrus.Fields{
+				errorKey: abortErr,
+			}).Error("Unable to abort transaction after failed commit")
+		}
+		session.ResetOffset(claim.Topic(), claim.Partition(), message.Offset, "")
+		return true, err
+	}
+
+	session.MarkMessage(message, "")
+	return false, nil
+}
+
 // Close method closes all resources used by consumer
 func (consumer *KafkaConsumer) Close() error {
 	if consumer.Cancel != nil {
@@ -245,26 +853,52 @@ func (consumer *KafkaConsumer) Close() error {
 		}
 	}
 
+	if consumer.DeadLetterProducer != nil {
+		if err := consumer.DeadLetterProducer.Close(); err != nil {
+			consumer.Logger.WithFields(logrus.Fields{
+				errorKey: err,
+			}).Error("Unable to close dead-letter producer")
+		}
+	}
+
 	return nil
 }
 
 // GetNumberOfSuccessfullyConsumedMessages returns number of consumed messages
 // since creating KafkaConsumer obj
 func (consumer *KafkaConsumer) GetNumberOfSuccessfullyConsumedMessages() uint64 {
-	return consumer.numberOfSuccessfullyConsumedMessages
+	return atomic.LoadUint64(&consumer.numberOfSuccessfullyConsumedMessages)
 }
 
 // GetNumberOfErrorsConsumingMessages returns number of errors during consuming messages
 // since creating KafkaConsumer obj
 func (consumer *KafkaConsumer) GetNumberOfErrorsConsumingMessages() uint64 {
-	return consumer.numberOfErrorsConsumingMessages
+	return atomic.LoadUint64(&consumer.numberOfErrorsConsumingMessages)
+}
+
+// GetNumberOfRetriableErrors returns the number of processing attempts
+// that failed but were (or still could be) retried
+func (consumer *KafkaConsumer) GetNumberOfRetriableErrors() uint64 {
+	return atomic.LoadUint64(&consumer.numberOfRetriableErrors)
 }
 
-// handleMessage handles the message and does all logging, metrics, etc
-func (consumer *KafkaConsumer) handleMessage(msg *sarama.ConsumerMessage) {
+// GetNumberOfTerminalErrors returns the number of messages whose
+// processing failed for good: after exhausting all retries, or after the
+// first attempt for a deserialization error, which is never retried
+func (consumer *KafkaConsumer) GetNumberOfTerminalErrors() uint64 {
+	return atomic.LoadUint64(&consumer.numberOfTerminalErrors)
+}
+
+// handleMessage handles the message and does all logging, metrics, etc.
+// It returns the processing error (nil if the message was stored, or
+// dead-lettered, successfully) so ExactlyOnce mode can decide whether to
+// commit or abort the surrounding Kafka transaction; AtLeastOnce callers
+// are free to ignore it, since the message is marked as consumed either
+// way.
+func (consumer *KafkaConsumer) handleMessage(msg *sarama.ConsumerMessage) error {
 	if msg == nil {
 		consumer.Logger.Info("nil message")
-		return
+		return nil
 	}
 
 	consumer.Logger.WithFields(logrus.Fields{
@@ -275,42 +909,140 @@ func (consumer *KafkaConsumer) handleMessage(msg *sarama.ConsumerMessage) {
 	}).Info("Start processing incoming message")
 
 	startTime := time.Now()
-	err := consumer.ProcessMessage(msg)
+	err := consumer.processMessageWithRetry(msg)
 	timeAfterProcessingMessage := time.Now()
+	processingDuration := timeAfterProcessingMessage.Sub(startTime).Seconds()
+
+	topic := msg.Topic
+	partition := strconv.Itoa(int(msg.Partition))
+	metrics.ProcessingDuration.WithLabelValues(topic, partition).Observe(processingDuration)
 
-	// Something went wrong while processing the message.
+	// Something went wrong while processing the message, even after
+	// retries, and either there is no dead-letter topic configured or
+	// producing the message to it failed.
 	if err != nil {
 		consumer.Logger.WithFields(logrus.Fields{
 			errorKey: err,
 		}).Error("Error processing the message consumed from Kafka")
-		consumer.numberOfErrorsConsumingMessages++
-		/* ConsumingErrors.Inc() */
-		return
+		atomic.AddUint64(&consumer.numberOfErrorsConsumingMessages, 1)
+		return err
 	}
 
 	consumer.Logger.WithFields(logrus.Fields{
 		offsetKey: msg.Offset,
 		partitionKey: msg.Partition,
 		topicKey: msg.Topic,
-		processingDurationKey: timeAfterProcessingMessage.Sub(startTime).Seconds(),
+		processingDurationKey: processingDuration,
 	}).Info("Processed incoming message successfully")
-	consumer.numberOfSuccessfullyConsumedMessages++
-	/*ConsumedMessages.Inc()*/
+	atomic.AddUint64(&consumer.numberOfSuccessfullyConsumedMessages, 1)
+	metrics.ConsumedMessages.Inc()
+	return nil
+}
+
+// processMessageWithRetry calls ProcessMessage, retrying on failure with
+// exponential backoff and jitter up to Config.MaxRetries times. If every
+// attempt fails, the message is routed to the dead-letter topic (when
+// configured) instead of being dropped.
+func (consumer *KafkaConsumer) processMessageWithRetry(msg *sarama.ConsumerMessage) error {
+	var err error
+	attempts := 0
+
+	for attempt := 0; attempt <= consumer.Config.MaxRetries; attempt++ {
+		attempts++
+		err = consumer.ProcessMessage(msg)
+		if err == nil {
+			return nil
+		}
+
+		var deserializationErr *DeserializationError
+		if errors.As(err, &deserializationErr) {
+			// A malformed/invalid payload will never succeed on retry, so
+			// go straight to the dead-letter path instead of burning the
+			// retry ladder meant for transient failures (e.g. DB outages)
+			consumer.Logger.WithFields(logrus.Fields{
+				errorKey: err,
+			}).Warn("Message failed deserialization/validation, skipping retries")
+			break
+		}
+
+		if attempt == consumer.Config.MaxRetries {
+			break
+		}
+
+		atomic.AddUint64(&consumer.numberOfRetriableErrors, 1)
+		consumer.Logger.WithFields(logrus.Fields{
+			errorKey:   err,
+			attemptKey: attempt,
+		}).Warn("Failed to process message, will retry")
+
+		time.Sleep(BackoffWithJitter(consumer.Config.RetryBackoff, attempt))
+	}
+
+	atomic.AddUint64(&consumer.numberOfTerminalErrors, 1)
+
+	if consumer.Config.DeadLetterTopic == "" {
+		return err
+	}
+
+	if dlqErr := consumer.produceToDeadLetter(msg, err, attempts); dlqErr != nil {
+		consumer.Logger.WithFields(logrus.Fields{
+			errorKey: dlqErr,
+		}).Error("Unable to produce message to dead-letter topic")
+		return err
+	}
+
+	consumer.Logger.WithFields(logrus.Fields{
+		offsetKey:    msg.Offset,
+		partitionKey: msg.Partition,
+		topicKey:     msg.Topic,
+	}).Info("Message routed to dead-letter topic after exhausting retries")
+
+	return nil
+}
+
+// BackoffWithJitter computes the delay to wait before the next retry
+// attempt, using a simple exponential backoff with up to 20% jitter.
+// Shared across Consumer backends.
+func BackoffWithJitter(base time.Duration, attempt int) time.Duration {
+	backoff := base * time.Duration(1<<uint(attempt))
+	jitter := time.Duration(rand.Int63n(int64(backoff) / 5 + 1))
+	return backoff + jitter
+}
+
+// produceToDeadLetter publishes the original message to the configured
+// dead-letter topic, carrying the original topic/partition/offset, the
+// processing error and the number of attempts made in message headers.
+func (consumer *KafkaConsumer) produceToDeadLetter(msg *sarama.ConsumerMessage, processingErr error, attempts int) error {
+	dlqMessage := &sarama.ProducerMessage{
+		Topic: consumer.Config.DeadLetterTopic,
+		Key:   sarama.ByteEncoder(msg.Key),
+		Value: sarama.ByteEncoder(msg.Value),
+		Headers: []sarama.RecordHeader{
+			{Key: []byte(headerOriginalTopic), Value: []byte(msg.Topic)},
+			{Key: []byte(headerOriginalPartition), Value: []byte(strconv.Itoa(int(msg.Partition)))},
+			{Key: []byte(headerOriginalOffset), Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+			{Key: []byte(headerError), Value: []byte(processingErr.Error())},
+			{Key: []byte(headerAttempts), Value: []byte(strconv.Itoa(attempts))},
+		},
+	}
+
+	_, _, err := consumer.DeadLetterProducer.SendMessage(dlqMessage)
+	return err
 }
 
 // ProcessMessage processes an incoming message
 func (consumer *KafkaConsumer) ProcessMessage(msg *sarama.ConsumerMessage) error {
 	tStart := time.Now()
 
-	// Step #1: parse the incoming message
-	message, err := parseMessage(msg.Value)
+	// Step #1: parse and validate the incoming message using the
+	// configured Deserializer (plain JSON by default, or schema-validated
+	// JSON/Avro, see KafkaConsumerConfig.PayloadFormat)
+	message, err := consumer.Deserializer.Deserialize(msg.Value)
 	if err != nil {
-		/* ParseIncomingMessageError.Inc() */
-		return err
+		metrics.ParseErrors.Inc()
+		return &DeserializationError{Err: err}
 	}
 
-	/* ParsedIncomingMessage.Inc() */
-
 	consumer.Logger.Info("Parsed incoming message successfully")
 
 	if message.Digests == nil {
@@ -319,7 +1051,7 @@ func (consumer *KafkaConsumer) ProcessMessage(msg *sarama.ConsumerMessage) error
 	}
 
 	// Step #2: get digests into a slice of strings
-	digests := extractDigestsFromMessage(message.Digests)
+	digests := ExtractDigestsFromMessage(message.Digests)
 
 	consumer.Logger.Infof("Extracted digests: %d", len(digests))
 
@@ -333,12 +1065,10 @@ func (consumer *KafkaConsumer) ProcessMessage(msg *sarama.ConsumerMessage) error
 		consumer.Logger.WithFields(logrus.Fields{
 			errorKey: err,
 		}).Error("Error writing digests to database")
-		/* StoredMessagesError.Inc() */
+		metrics.StoreErrors.Inc()
 		return err
 	}
 
-	/* StoredMessagesOk.Inc() */
-
 	// Step #5: print durations of all previous steps
 	consumer.Logger.WithFields(logrus.Fields{
 		processingDurationKey: time.Now().Sub(tStart).Seconds(),
@@ -347,7 +1077,9 @@ func (consumer *KafkaConsumer) ProcessMessage(msg *sarama.ConsumerMessage) error
 	return nil
 }
 
-func extractDigestsFromMessage(content *JsonContent) (digests []string) {
+// ExtractDigestsFromMessage extracts the image digests out of the
+// decoded message payload. Shared across Consumer backends.
+func ExtractDigestsFromMessage(content *JsonContent) (digests []string) {
 	// get the digest of each item
 	digests = make([]string, len(*content))
 	index := 0
@@ -359,8 +1091,9 @@ func extractDigestsFromMessage(content *JsonContent) (digests []string) {
 	return
 }
 
-// parseMessage tries to parse incoming message and verify all required attributes
-func parseMessage(messageValue []byte) (IncomingMessage, error) {
+// ParseMessage tries to parse incoming message and verify all required
+// attributes. Shared across Consumer backends.
+func ParseMessage(messageValue []byte) (IncomingMessage, error) {
 	var deserialized IncomingMessage
 
 	err := json.Unmarshal(messageValue, &deserialized)
@@ -0,0 +1,312 @@
+/*
+Copyright © 2022 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package digestwriter
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/sirupsen/logrus"
+)
+
+func TestBackoffWithJitter(t *testing.T) {
+	base := 100 * time.Millisecond
+
+	for attempt := 0; attempt < 5; attempt++ {
+		expectedBase := base * time.Duration(1<<uint(attempt))
+		maxJitter := expectedBase / 5
+
+		for i := 0; i < 20; i++ {
+			delay := BackoffWithJitter(base, attempt)
+			if delay < expectedBase || delay > expectedBase+maxJitter {
+				t.Fatalf("attempt %d: delay %s out of expected range [%s, %s]", attempt, delay, expectedBase, expectedBase+maxJitter)
+			}
+		}
+	}
+}
+
+// fakeClaim is a minimal sarama.ConsumerGroupClaim used to drive
+// commitInOrder without a real broker connection
+type fakeClaim struct {
+	topic         string
+	partition     int32
+	initialOffset int64
+}
+
+func (c *fakeClaim) Topic() string                            { return c.topic }
+func (c *fakeClaim) Partition() int32                         { return c.partition }
+func (c *fakeClaim) InitialOffset() int64                     { return c.initialOffset }
+func (c *fakeClaim) HighWaterMarkOffset() int64               { return c.initialOffset }
+func (c *fakeClaim) Messages() <-chan *sarama.ConsumerMessage { return nil }
+
+// fakeSession is a minimal sarama.ConsumerGroupSession that records every
+// MarkOffset call so tests can assert which offsets were committed
+type fakeSession struct {
+	ctx    context.Context
+	marked []int64
+	reset  []int64
+}
+
+func (s *fakeSession) Claims() map[string][]int32 { return nil }
+func (s *fakeSession) MemberID() string           { return "" }
+func (s *fakeSession) GenerationID() int32        { return 0 }
+func (s *fakeSession) MarkOffset(_ string, _ int32, offset int64, _ string) {
+	s.marked = append(s.marked, offset)
+}
+func (s *fakeSession) Commit() {}
+func (s *fakeSession) ResetOffset(_ string, _ int32, offset int64, _ string) {
+	s.reset = append(s.reset, offset)
+}
+func (s *fakeSession) MarkMessage(message *sarama.ConsumerMessage, _ string) {
+	s.marked = append(s.marked, message.Offset+1)
+}
+func (s *fakeSession) Context() context.Context { return s.ctx }
+
+// fakeTxnProducer is a minimal sarama.AsyncProducer double used to drive
+// commitMessageInTxn without a real broker connection. Each Begin/Add/Commit
+// call returns the corresponding configured error, if any, and every call is
+// counted so tests can assert exactly what happened.
+type fakeTxnProducer struct {
+	beginErr        error
+	addOffsetsErr   error
+	commitErr       error
+	txnStatus       sarama.ProducerTxnStatusFlag
+	beginCalls      int
+	addOffsetsCalls int
+	commitCalls     int
+	abortCalls      int
+}
+
+func (p *fakeTxnProducer) AsyncClose()                               {}
+func (p *fakeTxnProducer) Close() error                              { return nil }
+func (p *fakeTxnProducer) Input() chan<- *sarama.ProducerMessage     { return nil }
+func (p *fakeTxnProducer) Successes() <-chan *sarama.ProducerMessage { return nil }
+func (p *fakeTxnProducer) Errors() <-chan *sarama.ProducerError      { return nil }
+func (p *fakeTxnProducer) IsTransactional() bool                     { return true }
+func (p *fakeTxnProducer) TxnStatus() sarama.ProducerTxnStatusFlag   { return p.txnStatus }
+func (p *fakeTxnProducer) BeginTxn() error {
+	p.beginCalls++
+	return p.beginErr
+}
+func (p *fakeTxnProducer) CommitTxn() error {
+	p.commitCalls++
+	return p.commitErr
+}
+func (p *fakeTxnProducer) AbortTxn() error {
+	p.abortCalls++
+	return nil
+}
+func (p *fakeTxnProducer) AddOffsetsToTxn(_ map[string][]*sarama.PartitionOffsetMetadata, _ string) error {
+	p.addOffsetsCalls++
+	return p.addOffsetsErr
+}
+func (p *fakeTxnProducer) AddMessageToTxn(_ *sarama.ConsumerMessage, _ string, _ *string) error {
+	return nil
+}
+
+func TestCommitInOrderOnlyMarksContiguousPrefix(t *testing.T) {
+	claim := &fakeClaim{topic: "incoming", partition: 0, initialOffset: 10}
+	session := &fakeSession{ctx: context.Background()}
+
+	completed := make(chan int64)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		commitInOrder(session, claim, completed)
+	}()
+
+	// offsets 10, 11, 12 complete out of order; 12 arrives before 11, so
+	// nothing past 10 should be marked until the gap at 11 is filled
+	completed <- 10
+	completed <- 12
+	completed <- 11
+	close(completed)
+	<-done
+
+	expected := []int64{11, 12, 13}
+	if len(session.marked) != len(expected) {
+		t.Fatalf("expected marked offsets %v, got %v", expected, session.marked)
+	}
+	for i, offset := range expected {
+		if session.marked[i] != offset {
+			t.Fatalf("expected marked offsets %v, got %v", expected, session.marked)
+		}
+	}
+}
+
+func newTestKafkaConsumer() *KafkaConsumer {
+	logger := logrus.New()
+	logger.Out = io.Discard
+	return &KafkaConsumer{
+		Config: KafkaConsumerConfig{
+			CommonConsumerConfig: CommonConsumerConfig{Group: "test-group"},
+		},
+		Logger: logger,
+	}
+}
+
+func TestCommitMessageInTxnAbortsAndResetsOnProcessingFailure(t *testing.T) {
+	consumer := newTestKafkaConsumer()
+	producer := &fakeTxnProducer{}
+	claim := &fakeClaim{topic: "incoming", partition: 0}
+	session := &fakeSession{ctx: context.Background()}
+	message := &sarama.ConsumerMessage{Topic: "incoming", Partition: 0, Offset: 7}
+
+	aborted, err := consumer.commitMessageInTxn(producer, session, claim, message, errors.New("permanent processing failure"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !aborted {
+		t.Fatalf("expected aborted=true after a processing failure")
+	}
+	if producer.abortCalls != 1 {
+		t.Fatalf("expected AbortTxn to be called once, got %d", producer.abortCalls)
+	}
+	if producer.commitCalls != 0 {
+		t.Fatalf("expected CommitTxn not to be called, got %d", producer.commitCalls)
+	}
+	if len(session.reset) != 1 || session.reset[0] != message.Offset {
+		t.Fatalf("expected the partition offset to be reset to %d, got %v", message.Offset, session.reset)
+	}
+	if len(session.marked) != 0 {
+		t.Fatalf("expected no offset to be marked, got %v", session.marked)
+	}
+}
+
+func TestCommitMessageInTxnCommitsOnSuccess(t *testing.T) {
+	consumer := newTestKafkaConsumer()
+	producer := &fakeTxnProducer{}
+	claim := &fakeClaim{topic: "incoming", partition: 0}
+	session := &fakeSession{ctx: context.Background()}
+	message := &sarama.ConsumerMessage{Topic: "incoming", Partition: 0, Offset: 7}
+
+	aborted, err := consumer.commitMessageInTxn(producer, session, claim, message, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if aborted {
+		t.Fatalf("expected aborted=false on a successful commit")
+	}
+	if producer.commitCalls != 1 {
+		t.Fatalf("expected CommitTxn to be called once, got %d", producer.commitCalls)
+	}
+	if producer.abortCalls != 0 {
+		t.Fatalf("expected AbortTxn not to be called, got %d", producer.abortCalls)
+	}
+	if len(session.marked) != 1 || session.marked[0] != message.Offset+1 {
+		t.Fatalf("expected offset %d to be marked, got %v", message.Offset+1, session.marked)
+	}
+}
+
+func TestCommitMessageInTxnAbortsAndResetsOnCommitFailure(t *testing.T) {
+	consumer := newTestKafkaConsumer()
+	commitErr := errors.New("commit failed")
+	producer := &fakeTxnProducer{commitErr: commitErr}
+	claim := &fakeClaim{topic: "incoming", partition: 0}
+	session := &fakeSession{ctx: context.Background()}
+	message := &sarama.ConsumerMessage{Topic: "incoming", Partition: 0, Offset: 7}
+
+	aborted, err := consumer.commitMessageInTxn(producer, session, claim, message, nil)
+	if err != commitErr {
+		t.Fatalf("expected the CommitTxn error to be returned, got %v", err)
+	}
+	if !aborted {
+		t.Fatalf("expected aborted=true after a failed commit, so the caller stops consuming instead of letting a later message overwrite the reset offset")
+	}
+	if producer.abortCalls != 1 {
+		t.Fatalf("expected AbortTxn to be called once, got %d", producer.abortCalls)
+	}
+	if len(session.reset) != 1 || session.reset[0] != message.Offset {
+		t.Fatalf("expected the partition offset to be reset to %d, got %v", message.Offset, session.reset)
+	}
+}
+
+// fakeMessageClaim is a fakeClaim that also serves messages through a real
+// channel, so it can drive consumeClaimParallel's worker pool.
+type fakeMessageClaim struct {
+	fakeClaim
+	messages chan *sarama.ConsumerMessage
+}
+
+func (c *fakeMessageClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+// fakeStorage is a minimal Storage that records every digest written,
+// guarded by a mutex since consumeClaimParallel calls WriteDigests from
+// multiple worker goroutines at once.
+type fakeStorage struct {
+	mu      sync.Mutex
+	written [][]string
+}
+
+func (s *fakeStorage) WriteDigests(digests []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.written = append(s.written, digests)
+	return nil
+}
+
+// TestConsumeClaimParallelCountersUnderConcurrentWorkers exercises
+// consumeClaimParallel with ParallelMessages > 1, so handleMessage runs
+// concurrently across several goroutines; run with -race to catch any
+// unsynchronized access to the numberOf* counters.
+func TestConsumeClaimParallelCountersUnderConcurrentWorkers(t *testing.T) {
+	deserializer, err := NewDeserializer(PayloadFormatJSON, "", "")
+	if err != nil {
+		t.Fatalf("unexpected error building deserializer: %v", err)
+	}
+
+	consumer := newTestKafkaConsumer()
+	consumer.Config.ParallelMessages = 8
+	consumer.Deserializer = deserializer
+	consumer.Storage = &fakeStorage{}
+
+	const messageCount = 200
+	claim := &fakeMessageClaim{
+		fakeClaim: fakeClaim{topic: "incoming", partition: 0, initialOffset: 0},
+		messages:  make(chan *sarama.ConsumerMessage, messageCount),
+	}
+	for i := 0; i < messageCount; i++ {
+		claim.messages <- &sarama.ConsumerMessage{
+			Topic:     "incoming",
+			Partition: 0,
+			Offset:    int64(i),
+			Value:     []byte(`{"imageCount":1,"images":{"sha256:digest":null}}`),
+		}
+	}
+	close(claim.messages)
+
+	session := &fakeSession{ctx: context.Background()}
+
+	if err := consumer.consumeClaimParallel(session, claim); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := consumer.GetNumberOfSuccessfullyConsumedMessages(); got != messageCount {
+		t.Fatalf("expected %d successfully consumed messages, got %d", messageCount, got)
+	}
+	if got := consumer.GetNumberOfErrorsConsumingMessages(); got != 0 {
+		t.Fatalf("expected no consuming errors, got %d", got)
+	}
+	if len(session.marked) != messageCount {
+		t.Fatalf("expected %d offsets to be marked in order, got %d", messageCount, len(session.marked))
+	}
+}
@@ -0,0 +1,234 @@
+/*
+Copyright © 2022 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package digestwriter
+
+// This file contains the Deserializer abstraction used to turn a raw Kafka
+// message value into an IncomingMessage: plain JSON validated against a
+// required-attribute check (the historical behaviour), JSON validated
+// against a JSON Schema document, or Confluent-wire-format Avro resolved
+// against a Schema Registry. Protobuf is rejected by NewDeserializer.
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// PayloadFormat selects the Deserializer used to decode a message value
+type PayloadFormat string
+
+const (
+	// PayloadFormatJSON decodes plain JSON, optionally validated against
+	// a JSON Schema document (see KafkaConsumerConfig.JSONSchemaPath)
+	PayloadFormatJSON PayloadFormat = "json"
+
+	// PayloadFormatAvro decodes Confluent-wire-format Avro, resolving the
+	// writer schema from a Schema Registry
+	PayloadFormatAvro PayloadFormat = "avro"
+
+	// PayloadFormatProtobuf would decode Confluent-wire-format Protobuf,
+	// resolving the message schema from a Schema Registry. Not implemented
+	// yet (see NewDeserializer); the constant exists so configuration
+	// validation can give a specific error instead of "unsupported format"
+	PayloadFormatProtobuf PayloadFormat = "protobuf"
+)
+
+// confluentWireMagicByte is the leading byte of the Confluent wire format:
+// a magic 0x00 byte followed by a 4-byte big-endian schema ID
+const confluentWireMagicByte = 0x00
+
+// schemaRegistryTimeout bounds how long a single Schema Registry lookup
+// is allowed to take
+const schemaRegistryTimeout = 5 * time.Second
+
+// Deserializer decodes a raw Kafka message value into an IncomingMessage
+type Deserializer interface {
+	Deserialize(value []byte) (IncomingMessage, error)
+}
+
+// DeserializationError wraps any error returned by a Deserializer so that
+// the retry ladder in processMessageWithRetry can recognize it as
+// permanent (a malformed message will never parse on retry) and route it
+// straight to the dead-letter topic instead of retrying
+type DeserializationError struct {
+	Err error
+}
+
+func (e *DeserializationError) Error() string {
+	return fmt.Sprintf("failed to deserialize message: %s", e.Err)
+}
+
+func (e *DeserializationError) Unwrap() error {
+	return e.Err
+}
+
+// NewDeserializer builds the Deserializer configured via
+// KafkaConsumerConfig.PayloadFormat/JSONSchemaPath/SchemaRegistryURL
+func NewDeserializer(format PayloadFormat, jsonSchemaPath, schemaRegistryURL string) (Deserializer, error) {
+	switch format {
+	case "", PayloadFormatJSON:
+		return newJSONDeserializer(jsonSchemaPath)
+	case PayloadFormatAvro:
+		return newSchemaRegistryDeserializer(schemaRegistryURL, decodeAvro)
+	case PayloadFormatProtobuf:
+		// decodeProtobuf would need to also parse the varint-encoded
+		// message-index array the Confluent wire format prepends to
+		// identify which message in a multi-message .proto file was used;
+		// rather than ship a Deserializer that always fails, reject the
+		// format up front
+		return nil, fmt.Errorf("payload format %q is not implemented yet", format)
+	default:
+		return nil, fmt.Errorf("unsupported payload format: %q", format)
+	}
+}
+
+// jsonDeserializer decodes plain JSON, optionally validating it against a
+// JSON Schema document before handing it to ParseMessage
+type jsonDeserializer struct {
+	schema *jsonschema.Schema
+}
+
+func newJSONDeserializer(schemaPath string) (Deserializer, error) {
+	if schemaPath == "" {
+		return &jsonDeserializer{}, nil
+	}
+
+	schema, err := jsonschema.Compile(schemaPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to compile JSON Schema at %q: %w", schemaPath, err)
+	}
+
+	return &jsonDeserializer{schema: schema}, nil
+}
+
+func (d *jsonDeserializer) Deserialize(value []byte) (IncomingMessage, error) {
+	if d.schema != nil {
+		var generic interface{}
+		if err := json.Unmarshal(value, &generic); err != nil {
+			return IncomingMessage{}, err
+		}
+		if err := d.schema.Validate(generic); err != nil {
+			return IncomingMessage{}, err
+		}
+	}
+
+	return ParseMessage(value)
+}
+
+// schemaDecodeFunc decodes a payload given the writer schema fetched from
+// the Schema Registry, producing an IncomingMessage
+type schemaDecodeFunc func(schema string, payload []byte) (IncomingMessage, error)
+
+// schemaRegistryDeserializer decodes Confluent-wire-format messages,
+// caching schemas fetched from the registry by ID
+type schemaRegistryDeserializer struct {
+	registryURL string
+	httpClient  *http.Client
+	decode      schemaDecodeFunc
+
+	mu      sync.Mutex
+	schemas map[int]string
+}
+
+func newSchemaRegistryDeserializer(registryURL string, decode schemaDecodeFunc) (Deserializer, error) {
+	if registryURL == "" {
+		return nil, fmt.Errorf("KAFKA_SCHEMA_REGISTRY_URL is required for this payload format")
+	}
+
+	return &schemaRegistryDeserializer{
+		registryURL: registryURL,
+		httpClient:  &http.Client{Timeout: schemaRegistryTimeout},
+		decode:      decode,
+		schemas:     make(map[int]string),
+	}, nil
+}
+
+func (d *schemaRegistryDeserializer) Deserialize(value []byte) (IncomingMessage, error) {
+	if len(value) < 5 || value[0] != confluentWireMagicByte {
+		return IncomingMessage{}, fmt.Errorf("message value is not in Confluent wire format")
+	}
+
+	schemaID := int(binary.BigEndian.Uint32(value[1:5]))
+
+	schema, err := d.schemaByID(schemaID)
+	if err != nil {
+		return IncomingMessage{}, err
+	}
+
+	return d.decode(schema, value[5:])
+}
+
+func (d *schemaRegistryDeserializer) schemaByID(id int) (string, error) {
+	d.mu.Lock()
+	schema, ok := d.schemas[id]
+	d.mu.Unlock()
+	if ok {
+		return schema, nil
+	}
+
+	url := fmt.Sprintf("%s/schemas/ids/%d", d.registryURL, id)
+	response, err := d.httpClient.Get(url)
+	if err != nil {
+		return "", fmt.Errorf("unable to fetch schema %d from registry: %w", id, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("schema registry returned status %d for schema %d", response.StatusCode, id)
+	}
+
+	var body struct {
+		Schema string `json:"schema"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("unable to decode schema registry response for schema %d: %w", id, err)
+	}
+
+	d.mu.Lock()
+	d.schemas[id] = body.Schema
+	d.mu.Unlock()
+
+	return body.Schema, nil
+}
+
+// decodeAvro decodes an Avro-encoded payload using the given writer schema
+// and re-marshals it to JSON so it can be parsed by the same ParseMessage
+// logic as the plain-JSON path
+func decodeAvro(schema string, payload []byte) (IncomingMessage, error) {
+	codec, err := goavro.NewCodec(schema)
+	if err != nil {
+		return IncomingMessage{}, fmt.Errorf("invalid Avro schema: %w", err)
+	}
+
+	native, _, err := codec.NativeFromBinary(payload)
+	if err != nil {
+		return IncomingMessage{}, fmt.Errorf("unable to decode Avro payload: %w", err)
+	}
+
+	asJSON, err := json.Marshal(native)
+	if err != nil {
+		return IncomingMessage{}, err
+	}
+
+	return ParseMessage(asJSON)
+}
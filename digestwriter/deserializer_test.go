@@ -0,0 +1,81 @@
+/*
+Copyright © 2022 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package digestwriter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewDeserializerFormatDispatch(t *testing.T) {
+	tests := []struct {
+		name              string
+		format            PayloadFormat
+		schemaRegistryURL string
+		wantErr           bool
+	}{
+		{name: "empty format defaults to JSON", format: ""},
+		{name: "explicit JSON", format: PayloadFormatJSON},
+		{name: "Avro without registry URL", format: PayloadFormatAvro, wantErr: true},
+		{name: "Avro with registry URL", format: PayloadFormatAvro, schemaRegistryURL: "http://registry:8081"},
+		{name: "protobuf is not implemented", format: PayloadFormatProtobuf, schemaRegistryURL: "http://registry:8081", wantErr: true},
+		{name: "unknown format", format: "xml", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewDeserializer(test.format, "", test.schemaRegistryURL)
+			if test.wantErr && err == nil {
+				t.Fatalf("expected an error, got nil")
+			}
+			if !test.wantErr && err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSchemaRegistryDeserializerCachesSchemaByID(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_ = json.NewEncoder(w).Encode(map[string]string{"schema": `{"type":"string"}`})
+	}))
+	defer server.Close()
+
+	deserializer, err := newSchemaRegistryDeserializer(server.URL, func(schema string, payload []byte) (IncomingMessage, error) {
+		return IncomingMessage{}, fmt.Errorf("decode not exercised by this test")
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	registryDeserializer := deserializer.(*schemaRegistryDeserializer)
+
+	for i := 0; i < 3; i++ {
+		if _, err := registryDeserializer.schemaByID(42); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if requests != 1 {
+		t.Fatalf("expected the registry to be queried once and then served from cache, got %d requests", requests)
+	}
+}
@@ -0,0 +1,62 @@
+/*
+Copyright © 2022 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics provides the Prometheus collectors exposed by the
+// digestwriter Kafka consumer at /metrics
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	// ConsumedMessages counts messages handled without a terminal error:
+	// stored, carrying no digests, or routed to the dead-letter topic
+	ConsumedMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "vuln4shift_digestwriter_consumed_total",
+		Help: "The total number of messages consumed and successfully processed",
+	})
+
+	// ParseErrors counts messages that failed to deserialize/validate
+	ParseErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "vuln4shift_digestwriter_parse_errors_total",
+		Help: "The total number of messages that failed to parse or validate",
+	})
+
+	// StoreErrors counts failed attempts to write a message's digests to
+	// storage; a retried message is counted once per failed attempt
+	StoreErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "vuln4shift_digestwriter_store_errors_total",
+		Help: "The total number of failed attempts to write a message's digests to storage",
+	})
+
+	// ProcessingDuration tracks how long processing a single message
+	// takes, labeled by topic and partition
+	ProcessingDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "vuln4shift_digestwriter_processing_duration_seconds",
+		Help:    "Time taken to process a single Kafka message, in seconds",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"topic", "partition"})
+
+	// ConsumerLag tracks the difference between a partition's high water
+	// mark and the offset of the latest message handed to processing on it
+	ConsumerLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vuln4shift_digestwriter_consumer_lag",
+		Help: "Number of messages the consumer is behind the partition's high water mark",
+	}, []string{"topic", "partition"})
+)
+
+func init() {
+	prometheus.MustRegister(ConsumedMessages, ParseErrors, StoreErrors, ProcessingDuration, ConsumerLag)
+}
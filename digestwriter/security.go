@@ -0,0 +1,281 @@
+/*
+Copyright © 2022 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package digestwriter
+
+// This file contains the SASL/TLS security configuration for connecting to
+// Kafka brokers that require authentication (Confluent Cloud, MSK IAM,
+// Strimzi with mTLS, ...).
+
+import (
+	"app/base/utils"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+
+	"github.com/Shopify/sarama"
+	"github.com/xdg-go/scram"
+)
+
+// SASLMechanism selects the SASL authentication mechanism used to connect
+// to the Kafka broker
+type SASLMechanism string
+
+const (
+	// SASLMechanismNone disables SASL authentication
+	SASLMechanismNone SASLMechanism = ""
+
+	// SASLMechanismPlain is SASL/PLAIN
+	SASLMechanismPlain SASLMechanism = "PLAIN"
+
+	// SASLMechanismScramSHA256 is SASL/SCRAM-SHA-256
+	SASLMechanismScramSHA256 SASLMechanism = "SCRAM-SHA-256"
+
+	// SASLMechanismScramSHA512 is SASL/SCRAM-SHA-512
+	SASLMechanismScramSHA512 SASLMechanism = "SCRAM-SHA-512"
+
+	// SASLMechanismOAuthBearer is SASL/OAUTHBEARER
+	SASLMechanismOAuthBearer SASLMechanism = "OAUTHBEARER"
+)
+
+// SecurityConfig represents the SASL/TLS configuration used to establish a
+// connection to a Kafka broker that requires authentication
+type SecurityConfig struct {
+	// SASLMechanism is the SASL mechanism to use, or SASLMechanismNone to
+	// disable SASL entirely
+	SASLMechanism SASLMechanism
+	// SASLUsername is the SASL username, required for PLAIN and SCRAM
+	SASLUsername string
+	// SASLPassword is the SASL password, required for PLAIN and SCRAM
+	SASLPassword string
+	// OAuthTokenProvider supplies bearer tokens when SASLMechanism is
+	// SASLMechanismOAuthBearer
+	OAuthTokenProvider sarama.AccessTokenProvider
+	// TLSEnabled turns on TLS for the broker connection. It is implied by
+	// a non-empty TLSCACertPath, but can also be set on its own to use
+	// the system cert pool
+	TLSEnabled bool
+	// TLSCACertPath is the path to a PEM-encoded CA bundle used to verify
+	// the broker certificate. If empty, the system cert pool is used
+	TLSCACertPath string
+	// TLSClientCertPath and TLSClientKeyPath configure mutual TLS
+	TLSClientCertPath string
+	TLSClientKeyPath  string
+	// TLSInsecureSkipVerify disables broker certificate verification. It
+	// should only ever be used for local development
+	TLSInsecureSkipVerify bool
+}
+
+// SecurityConfigFromEnv builds a SecurityConfig from KAFKA_SASL_* and
+// KAFKA_TLS_* environment variables. It returns an error instead of
+// crashing mid-session when a mechanism is only partially configured
+func SecurityConfigFromEnv() (SecurityConfig, error) {
+	config := SecurityConfig{
+		SASLMechanism:         SASLMechanism(utils.Getenv("KAFKA_SASL_MECHANISM", "")),
+		SASLUsername:          utils.Getenv("KAFKA_SASL_USERNAME", ""),
+		SASLPassword:          utils.Getenv("KAFKA_SASL_PASSWORD", ""),
+		TLSCACertPath:         utils.Getenv("KAFKA_TLS_CA_CERT", ""),
+		TLSClientCertPath:     utils.Getenv("KAFKA_TLS_CLIENT_CERT", ""),
+		TLSClientKeyPath:      utils.Getenv("KAFKA_TLS_CLIENT_KEY", ""),
+		TLSInsecureSkipVerify: utils.Getenv("KAFKA_TLS_INSECURE_SKIP_VERIFY", "") == "true",
+	}
+
+	config.TLSEnabled = utils.Getenv("KAFKA_TLS_ENABLED", "") == "true" ||
+		config.TLSCACertPath != "" || config.TLSClientCertPath != ""
+
+	if err := config.validate(); err != nil {
+		return SecurityConfig{}, err
+	}
+
+	return config, nil
+}
+
+// validate rejects partially specified configurations, e.g. a SASL
+// mechanism without credentials, or a client cert without its key
+func (config *SecurityConfig) validate() error {
+	switch config.SASLMechanism {
+	case SASLMechanismNone:
+		// nothing to validate
+	case SASLMechanismPlain, SASLMechanismScramSHA256, SASLMechanismScramSHA512:
+		if config.SASLUsername == "" || config.SASLPassword == "" {
+			return fmt.Errorf("KAFKA_SASL_MECHANISM is set to %q but KAFKA_SASL_USERNAME/KAFKA_SASL_PASSWORD are missing", config.SASLMechanism)
+		}
+	case SASLMechanismOAuthBearer:
+		// token is supplied at runtime via OAuthTokenProvider
+	default:
+		return fmt.Errorf("unsupported KAFKA_SASL_MECHANISM: %q", config.SASLMechanism)
+	}
+
+	if (config.TLSClientCertPath == "") != (config.TLSClientKeyPath == "") {
+		return errors.New("KAFKA_TLS_CLIENT_CERT and KAFKA_TLS_CLIENT_KEY must be set together")
+	}
+
+	return nil
+}
+
+// Apply configures the SASL and TLS sections of a sarama.Config according
+// to this SecurityConfig
+func (config *SecurityConfig) Apply(saramaConfig *sarama.Config) error {
+	if err := config.applySASL(saramaConfig); err != nil {
+		return err
+	}
+	return config.applyTLS(saramaConfig)
+}
+
+func (config *SecurityConfig) applySASL(saramaConfig *sarama.Config) error {
+	if config.SASLMechanism == SASLMechanismNone {
+		return nil
+	}
+
+	saramaConfig.Net.SASL.Enable = true
+	saramaConfig.Net.SASL.User = config.SASLUsername
+	saramaConfig.Net.SASL.Password = config.SASLPassword
+
+	switch config.SASLMechanism {
+	case SASLMechanismPlain:
+		saramaConfig.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	case SASLMechanismScramSHA256:
+		saramaConfig.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+		saramaConfig.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &xdgSCRAMClient{hashGeneratorFcn: scram.SHA256}
+		}
+	case SASLMechanismScramSHA512:
+		saramaConfig.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+		saramaConfig.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &xdgSCRAMClient{hashGeneratorFcn: scram.SHA512}
+		}
+	case SASLMechanismOAuthBearer:
+		if config.OAuthTokenProvider == nil {
+			return errors.New("KAFKA_SASL_MECHANISM is set to OAUTHBEARER but no OAuthTokenProvider was configured")
+		}
+		saramaConfig.Net.SASL.Mechanism = sarama.SASLTypeOAuth
+		saramaConfig.Net.SASL.TokenProvider = config.OAuthTokenProvider
+	}
+
+	return nil
+}
+
+func (config *SecurityConfig) applyTLS(saramaConfig *sarama.Config) error {
+	if !config.TLSEnabled {
+		return nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.TLSInsecureSkipVerify,
+	}
+
+	if config.TLSCACertPath != "" {
+		caCert, err := os.ReadFile(config.TLSCACertPath)
+		if err != nil {
+			return fmt.Errorf("unable to read KAFKA_TLS_CA_CERT: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return fmt.Errorf("KAFKA_TLS_CA_CERT at %q does not contain a valid PEM certificate", config.TLSCACertPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.TLSClientCertPath != "" {
+		clientCert, err := tls.LoadX509KeyPair(config.TLSClientCertPath, config.TLSClientKeyPath)
+		if err != nil {
+			return fmt.Errorf("unable to load KAFKA_TLS_CLIENT_CERT/KAFKA_TLS_CLIENT_KEY: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	saramaConfig.Net.TLS.Enable = true
+	saramaConfig.Net.TLS.Config = tlsConfig
+
+	return nil
+}
+
+// ApplyToConfigMap returns the librdkafka configuration properties needed
+// to apply this SecurityConfig to a confluent-kafka-go consumer or
+// producer. It's expressed as generic string key/value pairs, rather than
+// a kafka.ConfigMap, so this file has no dependency on the
+// confluent-kafka-go package; digestwriter/confluent merges the result
+// into its own kafka.ConfigMap
+func (config *SecurityConfig) ApplyToConfigMap() (map[string]string, error) {
+	props := make(map[string]string)
+
+	securityProtocol := "PLAINTEXT"
+	if config.TLSEnabled {
+		securityProtocol = "SSL"
+	}
+
+	switch config.SASLMechanism {
+	case SASLMechanismNone:
+		// nothing to add
+	case SASLMechanismPlain, SASLMechanismScramSHA256, SASLMechanismScramSHA512:
+		if config.TLSEnabled {
+			securityProtocol = "SASL_SSL"
+		} else {
+			securityProtocol = "SASL_PLAINTEXT"
+		}
+		props["sasl.mechanism"] = string(config.SASLMechanism)
+		props["sasl.username"] = config.SASLUsername
+		props["sasl.password"] = config.SASLPassword
+	case SASLMechanismOAuthBearer:
+		return nil, errors.New("KAFKA_SASL_MECHANISM is set to OAUTHBEARER, which the confluent-kafka-go backend does not support yet")
+	default:
+		return nil, fmt.Errorf("unsupported KAFKA_SASL_MECHANISM: %q", config.SASLMechanism)
+	}
+
+	props["security.protocol"] = securityProtocol
+
+	if config.TLSCACertPath != "" {
+		props["ssl.ca.location"] = config.TLSCACertPath
+	}
+	if config.TLSClientCertPath != "" {
+		props["ssl.certificate.location"] = config.TLSClientCertPath
+		props["ssl.key.location"] = config.TLSClientKeyPath
+	}
+	if config.TLSInsecureSkipVerify {
+		props["enable.ssl.certificate.verification"] = "false"
+	}
+
+	return props, nil
+}
+
+// xdgSCRAMClient adapts github.com/xdg-go/scram to sarama.SCRAMClient
+type xdgSCRAMClient struct {
+	*scram.Client
+	*scram.ClientConversation
+	hashGeneratorFcn func() hash.Hash
+}
+
+func (client *xdgSCRAMClient) Begin(userName, password, authzID string) error {
+	scramClient, err := scram.NewClient(client.hashGeneratorFcn, userName, password)
+	if err != nil {
+		return err
+	}
+	client.Client = scramClient
+	client.ClientConversation = client.Client.NewConversation()
+	return nil
+}
+
+func (client *xdgSCRAMClient) Step(challenge string) (string, error) {
+	return client.ClientConversation.Step(challenge)
+}
+
+func (client *xdgSCRAMClient) Done() bool {
+	return client.ClientConversation.Done()
+}
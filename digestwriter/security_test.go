@@ -0,0 +1,130 @@
+/*
+Copyright © 2022 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package digestwriter
+
+import "testing"
+
+func TestSecurityConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  SecurityConfig
+		wantErr bool
+	}{
+		{
+			name:   "no SASL, no TLS",
+			config: SecurityConfig{},
+		},
+		{
+			name: "PLAIN with credentials",
+			config: SecurityConfig{
+				SASLMechanism: SASLMechanismPlain,
+				SASLUsername:  "user",
+				SASLPassword:  "pass",
+			},
+		},
+		{
+			name: "PLAIN without credentials",
+			config: SecurityConfig{
+				SASLMechanism: SASLMechanismPlain,
+			},
+			wantErr: true,
+		},
+		{
+			name: "SCRAM-SHA-256 without password",
+			config: SecurityConfig{
+				SASLMechanism: SASLMechanismScramSHA256,
+				SASLUsername:  "user",
+			},
+			wantErr: true,
+		},
+		{
+			name: "OAUTHBEARER needs no static credentials",
+			config: SecurityConfig{
+				SASLMechanism: SASLMechanismOAuthBearer,
+			},
+		},
+		{
+			name: "unsupported mechanism",
+			config: SecurityConfig{
+				SASLMechanism: "GSSAPI",
+			},
+			wantErr: true,
+		},
+		{
+			name: "client cert without client key",
+			config: SecurityConfig{
+				TLSClientCertPath: "/tmp/cert.pem",
+			},
+			wantErr: true,
+		},
+		{
+			name: "client cert with client key",
+			config: SecurityConfig{
+				TLSClientCertPath: "/tmp/cert.pem",
+				TLSClientKeyPath:  "/tmp/key.pem",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.config.validate()
+			if test.wantErr && err == nil {
+				t.Fatalf("expected an error, got nil")
+			}
+			if !test.wantErr && err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSecurityConfigApplyToConfigMap(t *testing.T) {
+	config := SecurityConfig{
+		SASLMechanism: SASLMechanismScramSHA512,
+		SASLUsername:  "user",
+		SASLPassword:  "pass",
+		TLSEnabled:    true,
+		TLSCACertPath: "/tmp/ca.pem",
+	}
+
+	props, err := config.ApplyToConfigMap()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	wantProps := map[string]string{
+		"security.protocol": "SASL_SSL",
+		"sasl.mechanism":    "SCRAM-SHA-512",
+		"sasl.username":     "user",
+		"sasl.password":     "pass",
+		"ssl.ca.location":   "/tmp/ca.pem",
+	}
+	for key, want := range wantProps {
+		if got := props[key]; got != want {
+			t.Errorf("props[%q] = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestSecurityConfigApplyToConfigMapRejectsOAuthBearer(t *testing.T) {
+	config := SecurityConfig{SASLMechanism: SASLMechanismOAuthBearer}
+
+	if _, err := config.ApplyToConfigMap(); err == nil {
+		t.Fatal("expected an error, got nil")
+	}
+}
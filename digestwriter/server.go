@@ -0,0 +1,121 @@
+/*
+Copyright © 2022 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package digestwriter
+
+// This file contains the HTTP server exposing Prometheus metrics and
+// Kubernetes/OpenShift liveness/readiness probes for a KafkaConsumer.
+
+import (
+	"app/base/utils"
+	"context"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultServerAddress is used when KAFKA_METRICS_ADDRESS is not configured
+const defaultServerAddress = ":8080"
+
+// Pinger is implemented by a Storage that can report whether its
+// underlying database connection is reachable. Storage implementations
+// that don't support it are simply treated as always ready by Server
+type Pinger interface {
+	Ping() error
+}
+
+// Server exposes /metrics, /healthz and /readyz for a KafkaConsumer, so it
+// can be wired into Kubernetes/OpenShift liveness and readiness probes
+type Server struct {
+	Addr     string
+	Consumer *KafkaConsumer
+	Storage  Storage
+	Logger   *logrus.Logger
+
+	httpServer *http.Server
+}
+
+// NewServer constructs a new Server. Addr defaults to KAFKA_METRICS_ADDRESS,
+// or ":8080" if that is not set
+func NewServer(consumer *KafkaConsumer, storage Storage, logger *logrus.Logger) *Server {
+	return &Server{
+		Addr:     utils.Getenv("KAFKA_METRICS_ADDRESS", defaultServerAddress),
+		Consumer: consumer,
+		Storage:  storage,
+		Logger:   logger,
+	}
+}
+
+// Start begins serving HTTP requests. It blocks until the server is
+// stopped via Close or fails to bind
+func (server *Server) Start() error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", server.handleHealthz)
+	mux.HandleFunc("/readyz", server.handleReadyz)
+
+	server.httpServer = &http.Server{
+		Addr:    server.Addr,
+		Handler: mux,
+	}
+
+	server.Logger.Infof("Starting metrics/health server on %s", server.Addr)
+
+	if err := server.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
+
+// Close gracefully shuts the server down
+func (server *Server) Close(ctx context.Context) error {
+	if server.httpServer == nil {
+		return nil
+	}
+	return server.httpServer.Shutdown(ctx)
+}
+
+// handleHealthz reports whether the consumer group session is alive, i.e.
+// whether Setup has fired without a matching Cleanup since
+func (server *Server) handleHealthz(w http.ResponseWriter, _ *http.Request) {
+	if !server.Consumer.SessionAlive() {
+		http.Error(w, "consumer group session is not alive", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleReadyz reports whether Setup has fired for the current consumer
+// group session and, if the configured Storage supports it, whether the
+// database is reachable
+func (server *Server) handleReadyz(w http.ResponseWriter, _ *http.Request) {
+	if !server.Consumer.IsReady() {
+		http.Error(w, "consumer session has not been set up yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	if pinger, ok := server.Storage.(Pinger); ok {
+		if err := pinger.Ping(); err != nil {
+			http.Error(w, "database ping failed: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}